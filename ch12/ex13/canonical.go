@@ -0,0 +1,471 @@
+// Copyright © 2016 Alan A. A. Donovan & Brian W. Kernighan.
+// License: https://creativecommons.org/licenses/by-nc-sa/4.0/
+
+package sexpr
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// MarshalCanonical returns v encoded as a Rivest Canonical S-Expression
+// (csexp): an atom is "<decimal-length>:<raw-bytes>", a list is
+// "(" sexp* ")", and there is no whitespace anywhere in the output.
+// Unlike the text form produced by Marshal, the canonical encoding of
+// a given value is always exactly one sequence of bytes, which makes
+// it suitable for hashing or signing.
+//
+// Complex64 and Complex128 are not supported: the text form's #C(re im)
+// syntax has no canonical-grammar equivalent, and csexp has no
+// established convention for complex numbers to follow instead.
+func MarshalCanonical(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeCanonicalValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalCanonical parses canonical S-expression data and populates
+// the variable whose address is in the non-nil pointer out.
+func UnmarshalCanonical(data []byte, out interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetCanonical(true)
+	return d.Decode(out)
+}
+
+// writeCanonicalAtom writes data as a length-prefixed canonical atom.
+func writeCanonicalAtom(buf *bytes.Buffer, data []byte) {
+	fmt.Fprintf(buf, "%d:", len(data))
+	buf.Write(data)
+}
+
+// writeCanonicalHint writes hint as a canonical display hint, "[...]",
+// which must be immediately followed by the value it annotates.
+func writeCanonicalHint(buf *bytes.Buffer, hint string) {
+	buf.WriteByte('[')
+	writeCanonicalAtom(buf, []byte(hint))
+	buf.WriteByte(']')
+}
+
+// writeCanonicalFields writes v's fields as a sequence of (name value)
+// pairs, flattening ",inline" and anonymous embedded struct fields
+// into their parent the same way writeStruct does for the text form.
+func writeCanonicalFields(buf *bytes.Buffer, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fv := v.Field(i)
+		name, opts := parseTag(f.Tag.Get("sexpr"))
+
+		if f.Type.Kind() == reflect.Struct && (f.Anonymous || hasOption(opts, "inline")) {
+			if err := writeCanonicalFields(buf, fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		if hasOption(opts, "omitempty") && fv.IsZero() {
+			continue
+		}
+		buf.WriteByte('(')
+		writeCanonicalAtom(buf, []byte(name))
+		if err := writeCanonicalValue(buf, fv); err != nil {
+			return err
+		}
+		buf.WriteByte(')')
+	}
+	return nil
+}
+
+// writeCanonicalValue is the canonical-codec counterpart of writeValue.
+// It does not consult Marshaler or encoding.TextMarshaler; those hooks
+// apply only to the text form.
+func writeCanonicalValue(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			// A nil pointer canonicalizes to the empty atom. This is
+			// ambiguous with a genuinely empty string/[]byte atom, but
+			// that's an acceptable shortcut for the common case.
+			writeCanonicalAtom(buf, nil)
+			return nil
+		}
+		return writeCanonicalValue(buf, v.Elem())
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			writeCanonicalAtom(buf, []byte("t"))
+		} else {
+			writeCanonicalAtom(buf, nil)
+		}
+
+	case reflect.String:
+		writeCanonicalAtom(buf, []byte(v.String()))
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeCanonicalAtom(buf, []byte(strconv.FormatInt(v.Int(), 10)))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeCanonicalAtom(buf, []byte(strconv.FormatUint(v.Uint(), 10)))
+
+	case reflect.Float32:
+		writeCanonicalAtom(buf, []byte(strconv.FormatFloat(v.Float(), 'g', -1, 32)))
+
+	case reflect.Float64:
+		writeCanonicalAtom(buf, []byte(strconv.FormatFloat(v.Float(), 'g', -1, 64)))
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 { // []byte is a bare atom
+			writeCanonicalAtom(buf, v.Bytes())
+			return nil
+		}
+		buf.WriteByte('(')
+		for i := 0; i < v.Len(); i++ {
+			if err := writeCanonicalValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(')')
+
+	case reflect.Array:
+		buf.WriteByte('(')
+		for i := 0; i < v.Len(); i++ {
+			if err := writeCanonicalValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(')')
+
+	case reflect.Struct:
+		buf.WriteByte('(')
+		if err := writeCanonicalFields(buf, v); err != nil {
+			return err
+		}
+		buf.WriteByte(')')
+
+	case reflect.Map:
+		// Entries are sorted by their encoded bytes so the output does not
+		// depend on map iteration order.
+		var entries [][]byte
+		for _, key := range v.MapKeys() {
+			var e bytes.Buffer
+			e.WriteByte('(')
+			if err := writeCanonicalValue(&e, key); err != nil {
+				return err
+			}
+			if err := writeCanonicalValue(&e, v.MapIndex(key)); err != nil {
+				return err
+			}
+			e.WriteByte(')')
+			entries = append(entries, e.Bytes())
+		}
+		sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i], entries[j]) < 0 })
+		buf.WriteByte('(')
+		buf.Write(bytes.Join(entries, nil))
+		buf.WriteByte(')')
+
+	case reflect.Interface:
+		if v.IsNil() {
+			writeCanonicalAtom(buf, nil)
+			return nil
+		}
+		elem := v.Elem()
+		writeCanonicalHint(buf, elem.Type().String())
+		return writeCanonicalValue(buf, elem)
+
+	default:
+		return fmt.Errorf("sexpr: cannot encode value of type %v", v.Type())
+	}
+	return nil
+}
+
+// readCanonicalLength reads the decimal length prefix of an atom, up
+// to and including the terminating ':'. A leading zero is rejected
+// except for the literal length "0".
+func readCanonicalLength(br *bufio.Reader) (int, error) {
+	var digits []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b == ':' {
+			break
+		}
+		if b < '0' || b > '9' {
+			return 0, fmt.Errorf("sexpr: invalid length-prefix byte %q", b)
+		}
+		digits = append(digits, b)
+	}
+	if len(digits) == 0 {
+		return 0, fmt.Errorf("sexpr: empty length prefix")
+	}
+	if len(digits) > 1 && digits[0] == '0' {
+		return 0, fmt.Errorf("sexpr: length prefix %q has a leading zero", digits)
+	}
+	n, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return 0, fmt.Errorf("sexpr: invalid length prefix %q: %v", digits, err)
+	}
+	return n, nil
+}
+
+// readCanonicalAtom reads one length-prefixed atom without ever
+// buffering more of the input than that atom requires.
+func readCanonicalAtom(br *bufio.Reader) ([]byte, error) {
+	n, err := readCanonicalLength(br)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func canonicalEndList(br *bufio.Reader) (bool, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return false, fmt.Errorf("sexpr: unexpected end of file")
+		}
+		return false, err
+	}
+	return b[0] == ')', nil
+}
+
+// readCanonicalValue is the canonical-codec counterpart of read.
+func readCanonicalValue(br *bufio.Reader, v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		if peeked, err := br.Peek(2); err == nil && peeked[0] == '0' && peeked[1] == ':' {
+			br.Discard(2)
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return readCanonicalValue(br, v.Elem())
+	}
+
+	b, err := br.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	switch b[0] {
+	case '(':
+		br.ReadByte()
+		if err := readCanonicalList(br, v); err != nil {
+			return err
+		}
+		closing, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if closing != ')' {
+			return fmt.Errorf("sexpr: expected ')', got %q", closing)
+		}
+		return nil
+
+	case '[':
+		br.ReadByte()
+		hint, err := readCanonicalAtom(br)
+		if err != nil {
+			return err
+		}
+		closing, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if closing != ']' {
+			return fmt.Errorf("sexpr: expected ']', got %q", closing)
+		}
+		if v.Kind() == reflect.Interface {
+			t, err := typeOf(string(hint))
+			if err != nil {
+				return fmt.Errorf("sexpr: %v", err)
+			}
+			value := reflect.New(t).Elem()
+			if err := readCanonicalValue(br, value); err != nil {
+				return err
+			}
+			v.Set(value)
+			return nil
+		}
+		return readCanonicalValue(br, v) // hint not meaningful for a concrete type
+
+	default:
+		atom, err := readCanonicalAtom(br)
+		if err != nil {
+			return err
+		}
+		return setCanonicalAtom(v, atom)
+	}
+}
+
+func readCanonicalList(br *bufio.Reader, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Array:
+		for i := 0; ; i++ {
+			end, err := canonicalEndList(br)
+			if err != nil {
+				return err
+			}
+			if end {
+				return nil
+			}
+			if err := readCanonicalValue(br, v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		for {
+			end, err := canonicalEndList(br)
+			if err != nil {
+				return err
+			}
+			if end {
+				return nil
+			}
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := readCanonicalValue(br, item); err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, item))
+		}
+
+	case reflect.Struct:
+		tags := fieldTags(v.Type())
+		for {
+			end, err := canonicalEndList(br)
+			if err != nil {
+				return err
+			}
+			if end {
+				return nil
+			}
+			if err := expectByte(br, '('); err != nil {
+				return err
+			}
+			nameBytes, err := readCanonicalAtom(br)
+			if err != nil {
+				return err
+			}
+			index, ok := tags[string(nameBytes)]
+			if !ok {
+				return fmt.Errorf("sexpr: unknown field %q", nameBytes)
+			}
+			if err := readCanonicalValue(br, v.FieldByIndex(index)); err != nil {
+				return err
+			}
+			if err := expectByte(br, ')'); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		for {
+			end, err := canonicalEndList(br)
+			if err != nil {
+				return err
+			}
+			if end {
+				return nil
+			}
+			if err := expectByte(br, '('); err != nil {
+				return err
+			}
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := readCanonicalValue(br, key); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := readCanonicalValue(br, value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+			if err := expectByte(br, ')'); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("sexpr: cannot decode list into %v", v.Type())
+	}
+}
+
+func expectByte(br *bufio.Reader, want byte) error {
+	got, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("sexpr: expected %q, got %q", want, got)
+	}
+	return nil
+}
+
+func setCanonicalAtom(v reflect.Value, atom []byte) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(string(atom) == "t")
+		return nil
+
+	case reflect.String:
+		v.SetString(string(atom))
+		return nil
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(atom)
+			return nil
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(string(atom), 10, 64)
+		if err != nil {
+			return fmt.Errorf("sexpr: invalid integer atom %q: %v", atom, err)
+		}
+		v.SetInt(n)
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(string(atom), 10, 64)
+		if err != nil {
+			return fmt.Errorf("sexpr: invalid integer atom %q: %v", atom, err)
+		}
+		v.SetUint(n)
+		return nil
+
+	case reflect.Float32:
+		f, err := strconv.ParseFloat(string(atom), 32)
+		if err != nil {
+			return fmt.Errorf("sexpr: invalid float atom %q: %v", atom, err)
+		}
+		v.SetFloat(f)
+		return nil
+
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(string(atom), 64)
+		if err != nil {
+			return fmt.Errorf("sexpr: invalid float atom %q: %v", atom, err)
+		}
+		v.SetFloat(f)
+		return nil
+	}
+	return fmt.Errorf("sexpr: cannot decode atom into %v", v.Type())
+}
@@ -9,63 +9,163 @@
 package sexpr
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"reflect"
 	"strconv"
 	"strings"
 	"text/scanner"
 )
 
+// A SyntaxError reports a problem encountered while decoding an
+// S-expression, along with the position in the input at which it
+// occurred. Unlike the panics this package used to raise, a
+// *SyntaxError is safe to return to a caller that fed it untrusted
+// or malformed data.
+type SyntaxError struct {
+	Msg    string
+	Line   int
+	Column int
+	Offset int
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("sexpr: %s (line %d, column %d)", e.Msg, e.Line, e.Column)
+}
+
 // !+Unmarshal
 // Unmarshal parses S-expression data and populates the variable
 // whose address is in the non-nil pointer out.
-func Unmarshal(data []byte, out interface{}) (err error) {
-	lex := &lexer{scan: scanner.Scanner{Mode: scanner.GoTokens}}
-	lex.scan.Init(bytes.NewReader(data))
-	lex.next() // get the first token
-	defer func() {
-		// NOTE: this is not an example of ideal error handling.
-		if x := recover(); x != nil {
-			err = fmt.Errorf("error at %s: %v", lex.scan.Position, x)
-		}
-	}()
-
-	//+ Exercise 12.12
-	// Build map of tags to field names
-	tags := make(map[string]string)
-	v := reflect.ValueOf(out).Elem() // the struct variable
-	for i := 0; i < v.NumField(); i++ {
-		fieldInfo := v.Type().Field(i) // a reflect.StructField
-		tag := fieldInfo.Tag           // a reflect.StructTag
-		name := tag.Get("sexpr")
-		if name == "" {
-			name = fieldInfo.Name
+func Unmarshal(data []byte, out interface{}) error {
+	return NewDecoder(bytes.NewReader(data)).Decode(out)
+}
+
+//!-Unmarshal
+
+// A Decoder reads and decodes S-expressions from an input stream.
+type Decoder struct {
+	lex       *lexer
+	br        *bufio.Reader
+	tee       *bytes.Buffer // mirrors every byte text/scanner has read from br, for Buffered
+	canonical bool
+	started   bool
+}
+
+// NewDecoder returns a new Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	br := bufio.NewReader(r)
+	tee := new(bytes.Buffer)
+	lex := &lexer{}
+	// text/scanner reads from br in its own large chunks, well ahead of
+	// what's actually been tokenized; mirroring those reads into tee is
+	// what lets Buffered recover the unconsumed remainder in text mode.
+	lex.scan.Init(io.TeeReader(br, tee)) // NOTE: Init resets Mode to GoTokens, so set it after.
+	// ScanChars and ScanRawStrings are disabled so that the reader-macro
+	// prefixes ' and ` (see Exercise chunk0-4) are handed to us as bare
+	// runes instead of being swallowed as Go character/raw-string literals.
+	lex.scan.Mode = scanner.GoTokens &^ (scanner.ScanChars | scanner.ScanRawStrings)
+	return &Decoder{lex: lex, br: br, tee: tee}
+}
+
+// SetCanonical switches the Decoder between the default text form and
+// Rivest's binary Canonical S-Expression form. It must be called
+// before the first call to Decode.
+func (d *Decoder) SetCanonical(canonical bool) {
+	d.canonical = canonical
+}
+
+// ensureStarted primes the lexer with its first token, the one call
+// to lex.next() that every other method relies on having already
+// happened. It is a no-op on every call after the first, so that
+// repeated Decode/Token/Skip calls on the same Decoder each resume
+// exactly where the previous one left off.
+func (d *Decoder) ensureStarted() {
+	if !d.started {
+		d.lex.next()
+		d.started = true
+	}
+}
+
+// Decode reads the next S-expression value from its input and stores
+// it in the value pointed to by out, which must be a non-nil pointer.
+func (d *Decoder) Decode(out interface{}) error {
+	if d.canonical {
+		if _, err := d.br.Peek(1); err != nil {
+			return io.EOF
 		}
-		tags[name] = fieldInfo.Name
+		return readCanonicalValue(d.br, reflect.ValueOf(out).Elem())
 	}
-	//- Exercise 12.12
 
-	read(lex, reflect.ValueOf(out).Elem(), tags)
-	return nil
+	d.ensureStarted()
+	if d.lex.token == scanner.EOF {
+		return io.EOF
+	}
+	return read(d.lex, reflect.ValueOf(out).Elem())
 }
 
-//!-Unmarshal
+// More reports whether there is another element in the input.
+func (d *Decoder) More() bool {
+	if d.canonical {
+		_, err := d.br.Peek(1)
+		return err == nil
+	}
+	d.ensureStarted()
+	return d.lex.token != scanner.EOF
+}
+
+// Buffered returns a reader of the input data that has been read but
+// not yet consumed, so a stream of values separated by caller-defined
+// framing (e.g. newlines) can be decoded safely: after Decode returns,
+// Buffered holds what comes after the value just decoded; in text mode
+// it starts at the next token, so whitespace and comments between the
+// value and that token are not included. In canonical mode this is simply the unread tail of the Decoder's own
+// bufio.Reader. In text mode, text/scanner reads ahead from that same
+// bufio.Reader in large chunks of its own, well past whatever it has
+// tokenized so far; the Decoder mirrors every byte text/scanner reads
+// into a side buffer so that remainder can still be recovered. The
+// reader is valid only until the next call to Decode.
+func (d *Decoder) Buffered() io.Reader {
+	if d.canonical {
+		return d.br
+	}
+	d.ensureStarted()
+	if d.lex.pos.Offset >= d.tee.Len() {
+		return bytes.NewReader(nil)
+	}
+	return bytes.NewReader(d.tee.Bytes()[d.lex.pos.Offset:])
+}
 
 // !+lexer
 type lexer struct {
 	scan  scanner.Scanner
-	token rune // the current token
+	token rune             // the current token
+	pos   scanner.Position // the position of the current token
 }
 
-func (lex *lexer) next()        { lex.token = lex.scan.Scan() }
+func (lex *lexer) next() {
+	lex.token = lex.scan.Scan()
+	lex.pos = lex.scan.Position
+}
 func (lex *lexer) text() string { return lex.scan.TokenText() }
 
-func (lex *lexer) consume(want rune) {
-	if lex.token != want { // NOTE: Not an example of good error handling.
-		panic(fmt.Sprintf("got %q, want %q", lex.text(), want))
+func (lex *lexer) consume(want rune) error {
+	if lex.token != want {
+		return lex.syntaxError("got %q, want %q", lex.text(), want)
 	}
 	lex.next()
+	return nil
+}
+
+// syntaxError builds a *SyntaxError positioned at the lexer's current token.
+func (lex *lexer) syntaxError(format string, args ...interface{}) error {
+	return &SyntaxError{
+		Msg:    fmt.Sprintf(format, args...),
+		Line:   lex.pos.Line,
+		Column: lex.pos.Column,
+		Offset: lex.pos.Offset,
+	}
 }
 
 //!-lexer
@@ -75,12 +175,13 @@ func (lex *lexer) consume(want rune) {
 // shortcuts.
 //
 // The parser assumes
-// - that the S-expression input is well-formed; it does no error checking.
 // - that the S-expression input corresponds to the type of the variable.
-// - that all numbers in the input are non-negative decimal integers.
 // - that all keys in ((key value) ...) struct syntax are unquoted symbols.
-// - that the input does not contain dotted lists such as (1 2 . 3).
-// - that the input does not contain Lisp reader macros such 'x and #'x.
+// Malformed input is reported as a *SyntaxError rather than causing a panic.
+// Dotted lists such as (1 2 . 3) decode only into a Pair, and reader
+// macros such as 'x decode only into an interface{} (see Exercise
+// chunk0-4); negative numbers and the #t/#f booleans are now supported
+// everywhere.
 //
 // The reflection logic assumes
 // - that v is always a variable of the appropriate type for the
@@ -92,7 +193,43 @@ func (lex *lexer) consume(want rune) {
 // - that if v is a numeric variable, it is a signed integer.
 
 // !+read
-func read(lex *lexer, v reflect.Value, tags map[string]string) {
+func read(lex *lexer, v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		if lex.token == scanner.Ident && lex.text() == "nil" {
+			v.Set(reflect.Zero(v.Type()))
+			lex.next()
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return read(lex, v.Elem())
+	}
+
+	if u, ok := asUnmarshaler(v); ok {
+		raw, err := lex.rawValue()
+		if err != nil {
+			return err
+		}
+		return u.UnmarshalSExpr(raw)
+	}
+
+	if tu, ok := asTextUnmarshaler(v); ok {
+		switch lex.token {
+		case scanner.String:
+			s, err := strconv.Unquote(lex.text())
+			if err != nil {
+				return lex.syntaxError("invalid string literal %s: %v", lex.text(), err)
+			}
+			lex.next()
+			return tu.UnmarshalText([]byte(s))
+		case scanner.Ident, scanner.Int, scanner.Float:
+			s := lex.text()
+			lex.next()
+			return tu.UnmarshalText([]byte(s))
+		}
+	}
+
 	switch lex.token {
 	case scanner.Ident:
 		// The only valid identifiers are
@@ -101,144 +238,316 @@ func read(lex *lexer, v reflect.Value, tags map[string]string) {
 		case "nil":
 			v.Set(reflect.Zero(v.Type()))
 			lex.next()
-			return
+			return nil
 		//+ Exercise 12.3
 		case "t":
 			v.SetBool(true)
 			lex.next()
-			return
+			return nil
 			//- Exercise 12.3
 		}
 
 	case scanner.String:
-		s, _ := strconv.Unquote(lex.text()) // NOTE: ignoring errors
+		s, err := strconv.Unquote(lex.text())
+		if err != nil {
+			return lex.syntaxError("invalid string literal %s: %v", lex.text(), err)
+		}
 		v.SetString(s)
 		lex.next()
-		return
+		return nil
 
 	case scanner.Int:
-		i, _ := strconv.Atoi(lex.text()) // NOTE: ignoring errors
-		if isSignedInt(v) {              // Exercise 12.10
+		i, err := strconv.Atoi(lex.text())
+		if err != nil {
+			return lex.syntaxError("invalid integer literal %s: %v", lex.text(), err)
+		}
+		signed, err := isSignedInt(v) // Exercise 12.10
+		if err != nil {
+			return lex.syntaxError("%v", err)
+		}
+		if signed {
 			v.SetInt(int64(i))
 		} else {
 			v.SetUint(uint64(i)) // Exercise 12.10
 		}
 		lex.next()
-		return
+		return nil
 
 	//+ Exercise 12.3
 	case scanner.Float:
 		switch v.Kind() {
 		case reflect.Float32:
-			f, _ := strconv.ParseFloat(lex.text(), 32) // NOTE: ignoring erros
+			f, err := strconv.ParseFloat(lex.text(), 32)
+			if err != nil {
+				return lex.syntaxError("invalid float literal %s: %v", lex.text(), err)
+			}
 			v.SetFloat(f)
 		case reflect.Float64:
-			f, _ := strconv.ParseFloat(lex.text(), 64) // NOTE: ignoring erros
+			f, err := strconv.ParseFloat(lex.text(), 64)
+			if err != nil {
+				return lex.syntaxError("invalid float literal %s: %v", lex.text(), err)
+			}
 			v.SetFloat(f)
 		default:
-			panic(fmt.Sprintf("unexpected type: %d", v.Kind()))
+			return lex.syntaxError("unexpected type: %v", v.Kind())
 		}
 		lex.next()
-		return
+		return nil
 
 	case '#':
-		lex.next() // Ident
-		lex.next() // '('
-		lex.next() // Float
-		r := lex.text()
-		lex.next() // Float
-		i := lex.text()
-		lex.next() // ')'
-		lex.consume(')')
-
-		var bitSize int
-		switch v.Kind() {
-		case reflect.Complex64:
-			bitSize = 32
-		case reflect.Complex128:
-			bitSize = 64
-		default:
-			panic(fmt.Sprintf("unexpected type: %d", v.Kind()))
+		lex.next() // Ident: "t", "f", or "C"
+		if lex.token == scanner.Ident {
+			switch lex.text() {
+			//+ Exercise chunk0-4
+			case "t":
+				v.SetBool(true)
+				lex.next()
+				return nil
+			case "f":
+				v.SetBool(false)
+				lex.next()
+				return nil
+				//- Exercise chunk0-4
+			case "C":
+				lex.next() // '('
+				lex.next() // Float
+				r := lex.text()
+				lex.next() // Float
+				i := lex.text()
+				lex.next() // ')'
+				if err := lex.consume(')'); err != nil {
+					return err
+				}
+
+				var bitSize int
+				switch v.Kind() {
+				case reflect.Complex64:
+					bitSize = 32
+				case reflect.Complex128:
+					bitSize = 64
+				default:
+					return lex.syntaxError("unexpected type: %v", v.Kind())
+				}
+				fr, err := strconv.ParseFloat(r, bitSize)
+				if err != nil {
+					return lex.syntaxError("invalid complex real part %s: %v", r, err)
+				}
+				fi, err := strconv.ParseFloat(i, bitSize)
+				if err != nil {
+					return lex.syntaxError("invalid complex imaginary part %s: %v", i, err)
+				}
+				v.SetComplex(complex(fr, fi))
+				return nil
+			}
 		}
-		fr, _ := strconv.ParseFloat(r, bitSize)
-		fi, _ := strconv.ParseFloat(i, bitSize)
-		v.SetComplex(complex(fr, fi))
-		return
+		return lex.syntaxError("unsupported # form")
 	//- Exercise 12.3
 
-	case '(':
+	//+ Exercise chunk0-4
+	case '-':
 		lex.next()
-		readList(lex, v, tags)
-		lex.next() // consume ')'
-		return
+		switch lex.token {
+		case scanner.Int:
+			i, err := strconv.Atoi(lex.text())
+			if err != nil {
+				return lex.syntaxError("invalid integer literal -%s: %v", lex.text(), err)
+			}
+			signed, err := isSignedInt(v)
+			if err != nil {
+				return lex.syntaxError("%v", err)
+			}
+			if !signed {
+				return lex.syntaxError("negative value not allowed for unsigned type %v", v.Type())
+			}
+			v.SetInt(-int64(i))
+			lex.next()
+			return nil
+
+		case scanner.Float:
+			switch v.Kind() {
+			case reflect.Float32:
+				f, err := strconv.ParseFloat(lex.text(), 32)
+				if err != nil {
+					return lex.syntaxError("invalid float literal -%s: %v", lex.text(), err)
+				}
+				v.SetFloat(-f)
+			case reflect.Float64:
+				f, err := strconv.ParseFloat(lex.text(), 64)
+				if err != nil {
+					return lex.syntaxError("invalid float literal -%s: %v", lex.text(), err)
+				}
+				v.SetFloat(-f)
+			default:
+				return lex.syntaxError("unexpected type: %v", v.Kind())
+			}
+			lex.next()
+			return nil
 
+		default:
+			return lex.syntaxError("unexpected token after '-': %q", lex.text())
+		}
+
+	case '\'', '`', ',':
+		val, err := decodeDynamic(lex)
+		if err != nil {
+			return err
+		}
+		if v.Kind() != reflect.Interface {
+			return lex.syntaxError("a quoted form can only be decoded into an interface{} field")
+		}
+		v.Set(reflect.ValueOf(val))
+		return nil
+		//- Exercise chunk0-4
+
+	case '(':
+		lex.next()
+		if err := readList(lex, v); err != nil {
+			return err
+		}
+		return lex.consume(')')
 	}
-	panic(fmt.Sprintf("unexpected token %d %q", lex.token, lex.text()))
+	return lex.syntaxError("unexpected token %d %q", lex.token, lex.text())
 }
 
 //!-read
 
 // !+readlist
-func readList(lex *lexer, v reflect.Value, tags map[string]string) {
+func readList(lex *lexer, v reflect.Value) error {
 	switch v.Kind() {
 	case reflect.Array: // (item ...)
-		for i := 0; !endList(lex); i++ {
-			read(lex, v.Index(i), tags)
+		for i := 0; ; i++ {
+			end, err := endList(lex)
+			if err != nil {
+				return err
+			}
+			if end {
+				return nil
+			}
+			if err := read(lex, v.Index(i)); err != nil {
+				return err
+			}
 		}
 
 	case reflect.Slice: // (item ...)
-		for !endList(lex) {
+		for {
+			end, err := endList(lex)
+			if err != nil {
+				return err
+			}
+			if end {
+				return nil
+			}
 			item := reflect.New(v.Type().Elem()).Elem()
-			read(lex, item, tags)
+			if err := read(lex, item); err != nil {
+				return err
+			}
 			v.Set(reflect.Append(v, item))
 		}
 
 	case reflect.Struct: // ((name value) ...)
-		for !endList(lex) {
-			lex.consume('(')
+		//+ Exercise chunk0-4
+		if v.Type() == pairType {
+			val, err := readPair(lex)
+			if err != nil {
+				return err
+			}
+			if val == nil {
+				v.Set(reflect.Zero(v.Type()))
+				return nil
+			}
+			v.Set(reflect.ValueOf(val))
+			return nil
+		}
+		//- Exercise chunk0-4
+
+		tags := fieldTags(v.Type())
+		for {
+			end, err := endList(lex)
+			if err != nil {
+				return err
+			}
+			if end {
+				return nil
+			}
+			if err := lex.consume('('); err != nil {
+				return err
+			}
 			if lex.token != scanner.Ident {
-				panic(fmt.Sprintf("got token %q, want field name", lex.text()))
+				return lex.syntaxError("got token %q, want field name", lex.text())
 			}
 			name := lex.text()
 			lex.next()
-			read(lex, v.FieldByName(tags[name]), tags) // Exercise 12.12
-			lex.consume(')')
+			index, ok := tags[name]
+			if !ok {
+				return lex.syntaxError("unknown field %q", name)
+			}
+			if err := read(lex, v.FieldByIndex(index)); err != nil {
+				return err
+			}
+			if err := lex.consume(')'); err != nil {
+				return err
+			}
 		}
 
 	case reflect.Map: // ((key value) ...)
 		v.Set(reflect.MakeMap(v.Type()))
-		for !endList(lex) {
-			lex.consume('(')
+		for {
+			end, err := endList(lex)
+			if err != nil {
+				return err
+			}
+			if end {
+				return nil
+			}
+			if err := lex.consume('('); err != nil {
+				return err
+			}
 			key := reflect.New(v.Type().Key()).Elem()
-			read(lex, key, tags)
+			if err := read(lex, key); err != nil {
+				return err
+			}
 			value := reflect.New(v.Type().Elem()).Elem()
-			read(lex, value, tags)
+			if err := read(lex, value); err != nil {
+				return err
+			}
 			v.SetMapIndex(key, value)
-			lex.consume(')')
+			if err := lex.consume(')'); err != nil {
+				return err
+			}
 		}
 
 	//+ Exercise 12.3
-	case reflect.Interface: //
-		t, _ := strconv.Unquote(lex.text())
-		value := reflect.New(typeOf(t)).Elem()
+	case reflect.Interface:
+		s, err := strconv.Unquote(lex.text())
+		if err != nil {
+			return lex.syntaxError("invalid type tag %s: %v", lex.text(), err)
+		}
+		t, err := typeOf(s)
+		if err != nil {
+			return lex.syntaxError("%v", err)
+		}
+		value := reflect.New(t).Elem()
 		lex.next()
-		read(lex, value, tags)
+		if err := read(lex, value); err != nil {
+			return err
+		}
 		v.Set(value)
+		return nil
 	//- Exercise 12.3
 
 	default:
-		panic(fmt.Sprintf("cannot decode list into %v", v.Type()))
+		return lex.syntaxError("cannot decode list into %v", v.Type())
 	}
 }
 
-func endList(lex *lexer) bool {
+func endList(lex *lexer) (bool, error) {
 	switch lex.token {
 	case scanner.EOF:
-		panic("end of file")
+		return false, lex.syntaxError("unexpected end of file")
 	case ')':
-		return true
+		return true, nil
 	}
-	return false
+	return false, nil
 }
 
 //!-readlist
@@ -261,50 +570,68 @@ var maps = map[string]reflect.Type{
 	"complex128": reflect.TypeOf(complex128(0 + 0i)),
 }
 
-// typeOf returns reflect.Type, but does not support all primitive types yet
-// and cannot support all possible types.
-func typeOf(tName string) reflect.Type {
-	t, ok := maps[tName]
-	if ok {
-		return t
+// typeOf returns the reflect.Type named by tName, but does not support
+// all primitive types yet and cannot support all possible types.
+func typeOf(tName string) (reflect.Type, error) {
+	if t, ok := maps[tName]; ok {
+		return t, nil
 	}
 
 	// slice
 	if strings.HasPrefix(tName, "[]") {
-		return reflect.SliceOf(typeOf(tName[2:]))
+		elem, err := typeOf(tName[2:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elem), nil
 	}
 
 	// array
-	if tName[0] == '[' {
+	if len(tName) > 0 && tName[0] == '[' {
 		i := strings.Index(tName, "]")
 		if i > 0 {
-			len, _ := strconv.Atoi(tName[1:i]) // NOTE: ignoring errors
-			return reflect.ArrayOf(len, typeOf(tName[i+1:]))
+			n, err := strconv.Atoi(tName[1:i])
+			if err != nil {
+				return nil, fmt.Errorf("%s not supported yet: %v", tName, err)
+			}
+			elem, err := typeOf(tName[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			return reflect.ArrayOf(n, elem), nil
 		}
 	}
 
 	if strings.HasPrefix(tName, "map") {
 		i := strings.Index(tName, "]")
 		if i > 0 {
-			return reflect.MapOf(typeOf(tName[4:i]), typeOf(tName[i+1:]))
+			key, err := typeOf(tName[4:i])
+			if err != nil {
+				return nil, err
+			}
+			elem, err := typeOf(tName[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			return reflect.MapOf(key, elem), nil
 		}
 	}
 
-	panic(fmt.Sprintf("%s not supported yet\n", tName))
+	return nil, fmt.Errorf("%s not supported yet", tName)
 }
 
-func isSignedInt(v reflect.Value) bool {
+func isSignedInt(v reflect.Value) (bool, error) {
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16,
 		reflect.Int32, reflect.Int64:
-		return true
+		return true, nil
 
 	case reflect.Uint, reflect.Uint8, reflect.Uint16,
 		reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		return false
+		return false, nil
 
 	default:
-		panic(fmt.Sprintf("isSignedInt: v.Kind(%d) not supported", v.Kind()))
+		return false, fmt.Errorf("isSignedInt: v.Kind(%d) not supported", v.Kind())
 	}
 }
 
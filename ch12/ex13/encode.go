@@ -0,0 +1,180 @@
+// Copyright © 2016 Alan A. A. Donovan & Brian W. Kernighan.
+// License: https://creativecommons.org/licenses/by-nc-sa/4.0/
+
+package sexpr
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Marshal returns the S-expression encoding of v.
+//
+// Marshal is the mirror image of Unmarshal: it walks v with the same
+// struct tags (including ",omitempty" and ",inline") and honours
+// Marshaler and encoding.TextMarshaler the same way Unmarshal honours
+// their decoding counterparts.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if m, ok := asMarshaler(v); ok {
+		data, err := m.MarshalSExpr()
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		return nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			buf.WriteString("nil")
+			return nil
+		}
+		return writeValue(buf, v.Elem())
+	}
+
+	if tm, ok := asTextMarshaler(v); ok {
+		text, err := tm.MarshalText()
+		if err != nil {
+			return err
+		}
+		buf.WriteString(strconv.Quote(string(text)))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("t")
+		} else {
+			buf.WriteString("nil")
+		}
+
+	case reflect.String:
+		buf.WriteString(strconv.Quote(v.String()))
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprintf(buf, "%d", v.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		fmt.Fprintf(buf, "%d", v.Uint())
+
+	case reflect.Float32:
+		fmt.Fprintf(buf, "%s", strconv.FormatFloat(v.Float(), 'g', -1, 32))
+
+	case reflect.Float64:
+		fmt.Fprintf(buf, "%s", strconv.FormatFloat(v.Float(), 'g', -1, 64))
+
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		fmt.Fprintf(buf, "#C(%g %g)", real(c), imag(c))
+
+	case reflect.Array, reflect.Slice:
+		buf.WriteByte('(')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			if err := writeValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(')')
+
+	case reflect.Struct:
+		return writeStruct(buf, v)
+
+	case reflect.Map:
+		buf.WriteByte('(')
+		for i, key := range v.MapKeys() {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteByte('(')
+			if err := writeValue(buf, key); err != nil {
+				return err
+			}
+			buf.WriteByte(' ')
+			if err := writeValue(buf, v.MapIndex(key)); err != nil {
+				return err
+			}
+			buf.WriteByte(')')
+		}
+		buf.WriteByte(')')
+
+	case reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("nil")
+			return nil
+		}
+		elem := v.Elem()
+		buf.WriteByte('(')
+		fmt.Fprintf(buf, "%q", elem.Type().String())
+		buf.WriteByte(' ')
+		if err := writeValue(buf, elem); err != nil {
+			return err
+		}
+		buf.WriteByte(')')
+		return nil
+
+	default:
+		return fmt.Errorf("sexpr: cannot encode value of type %v", v.Type())
+	}
+	return nil
+}
+
+// writeStruct encodes v, a struct value, as ((name value) ...), honouring
+// ",inline" fields (flattened into the parent list) and ",omitempty"
+// fields (skipped when they hold their zero value).
+func writeStruct(buf *bytes.Buffer, v reflect.Value) error {
+	buf.WriteByte('(')
+	first := true
+	var write func(v reflect.Value) error
+	write = func(v reflect.Value) error {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fv := v.Field(i)
+			name, opts := parseTag(f.Tag.Get("sexpr"))
+
+			if f.Type.Kind() == reflect.Struct && (f.Anonymous || hasOption(opts, "inline")) {
+				if err := write(fv); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if name == "" {
+				name = f.Name
+			}
+			if hasOption(opts, "omitempty") && fv.IsZero() {
+				continue
+			}
+
+			if !first {
+				buf.WriteByte(' ')
+			}
+			first = false
+			fmt.Fprintf(buf, "(%s ", name)
+			if err := writeValue(buf, fv); err != nil {
+				return err
+			}
+			buf.WriteByte(')')
+		}
+		return nil
+	}
+	if err := write(v); err != nil {
+		return err
+	}
+	buf.WriteByte(')')
+	return nil
+}
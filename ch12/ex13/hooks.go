@@ -0,0 +1,174 @@
+// Copyright © 2016 Alan A. A. Donovan & Brian W. Kernighan.
+// License: https://creativecommons.org/licenses/by-nc-sa/4.0/
+
+package sexpr
+
+import (
+	"bytes"
+	"encoding"
+	"reflect"
+	"text/scanner"
+)
+
+// Marshaler is implemented by types that can encode themselves into a
+// valid S-expression. MarshalSExpr is called in place of the package's
+// usual reflection-driven encoding, mirroring json.Marshaler.
+type Marshaler interface {
+	MarshalSExpr() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that can decode an S-expression
+// representation of themselves. UnmarshalSExpr is called in place of
+// the package's usual reflection-driven decoding, mirroring
+// json.Unmarshaler. The data passed to UnmarshalSExpr is not
+// guaranteed to be byte-identical to the original input — whitespace
+// between atoms is normalized to single spaces — but it is always a
+// single, complete, well-formed S-expression.
+type Unmarshaler interface {
+	UnmarshalSExpr([]byte) error
+}
+
+// asUnmarshaler reports whether v implements Unmarshaler, checking
+// *v when v is addressable, as encoding/json does for json.Unmarshaler.
+func asUnmarshaler(v reflect.Value) (Unmarshaler, bool) {
+	if !v.CanAddr() {
+		return nil, false
+	}
+	u, ok := v.Addr().Interface().(Unmarshaler)
+	return u, ok
+}
+
+// asTextUnmarshaler reports whether v implements encoding.TextUnmarshaler,
+// checking *v when v is addressable. time.Time and similar scalar types
+// are decoded through this fallback when they don't implement Unmarshaler
+// directly.
+func asTextUnmarshaler(v reflect.Value) (encoding.TextUnmarshaler, bool) {
+	if !v.CanAddr() {
+		return nil, false
+	}
+	u, ok := v.Addr().Interface().(encoding.TextUnmarshaler)
+	return u, ok
+}
+
+// asTextMarshaler reports whether v implements encoding.TextMarshaler.
+func asTextMarshaler(v reflect.Value) (encoding.TextMarshaler, bool) {
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		return m, true
+	}
+	if v.CanAddr() {
+		if m, ok := v.Addr().Interface().(encoding.TextMarshaler); ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// asMarshaler reports whether v (or its address) implements Marshaler.
+func asMarshaler(v reflect.Value) (Marshaler, bool) {
+	if m, ok := v.Interface().(Marshaler); ok {
+		return m, true
+	}
+	if v.CanAddr() {
+		if m, ok := v.Addr().Interface().(Marshaler); ok {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// RawMessage is a raw encoded S-expression, captured verbatim for
+// later decoding, mirroring json.RawMessage. A struct field of type
+// RawMessage is left unparsed until something else unmarshals it.
+type RawMessage []byte
+
+// MarshalSExpr returns m unaltered.
+func (m RawMessage) MarshalSExpr() ([]byte, error) {
+	return m, nil
+}
+
+// UnmarshalSExpr sets *m to a copy of data.
+func (m *RawMessage) UnmarshalSExpr(data []byte) error {
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+// rawValue consumes the next complete S-expression from lex and
+// returns a reconstruction of its source text, for handing to a
+// Unmarshaler. It is not guaranteed to be byte-identical to the
+// original input.
+func (lex *lexer) rawValue() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := lex.copyValue(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (lex *lexer) copyValue(buf *bytes.Buffer) error {
+	switch lex.token {
+	case '(':
+		buf.WriteByte('(')
+		lex.next()
+		first := true
+		for lex.token != ')' {
+			if lex.token == scanner.EOF {
+				return lex.syntaxError("unexpected end of file")
+			}
+			if !first {
+				buf.WriteByte(' ')
+			}
+			first = false
+			if err := lex.copyValue(buf); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(')')
+		lex.next()
+		return nil
+
+	case '-':
+		// A negative number is two tokens ('-' then Int/Float); copy
+		// both so the atom isn't truncated to just the sign.
+		buf.WriteByte('-')
+		lex.next()
+		return lex.copyValue(buf)
+
+	case '\'', '`':
+		// A reader-macro prefix is followed by the value it quotes.
+		buf.WriteRune(lex.token)
+		lex.next()
+		return lex.copyValue(buf)
+
+	case ',':
+		buf.WriteByte(',')
+		lex.next()
+		if lex.token == '@' {
+			buf.WriteByte('@')
+			lex.next()
+		}
+		return lex.copyValue(buf)
+
+	case '#':
+		// #t and #f are two tokens ('#' then an Ident); #C(re im) is
+		// '#' followed by "C" and a parenthesized pair. Copy all of it.
+		buf.WriteByte('#')
+		lex.next()
+		if lex.token != scanner.Ident {
+			return lex.syntaxError("unsupported # form")
+		}
+		switch lex.text() {
+		case "t", "f":
+			buf.WriteString(lex.text())
+			lex.next()
+			return nil
+		case "C":
+			buf.WriteString("C")
+			lex.next()
+			return lex.copyValue(buf)
+		}
+		return lex.syntaxError("unsupported # form")
+	}
+	buf.WriteString(lex.text())
+	lex.next()
+	return nil
+}
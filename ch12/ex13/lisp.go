@@ -0,0 +1,190 @@
+// Copyright © 2016 Alan A. A. Donovan & Brian W. Kernighan.
+// License: https://creativecommons.org/licenses/by-nc-sa/4.0/
+
+package sexpr
+
+import (
+	"reflect"
+	"strconv"
+	"text/scanner"
+)
+
+// Quote represents a Lisp reader-macro form after expansion to its
+// canonical list shape: 'x is Quote{"quote", x}, `x is
+// Quote{"quasiquote", x}, ,x is Quote{"unquote", x}, and ,@x is
+// Quote{"unquote-splicing", x}. Quote forms can only be decoded into
+// an interface{}, since a statically typed Go field has no way to
+// express "a symbol or the value it quotes".
+type Quote struct {
+	Symbol string
+	Value  interface{}
+}
+
+// Pair is a Lisp cons cell. It is the decode target for dotted-pair
+// and improper-list S-expressions such as (1 . 2) or (1 2 . 3), which
+// have no natural representation as a Go slice or array. The elements
+// of a proper list decoded into a Pair chain have a final Cdr of nil.
+type Pair struct {
+	Car interface{}
+	Cdr interface{}
+}
+
+var pairType = reflect.TypeOf(Pair{})
+
+var quoteSymbols = map[rune]string{
+	'\'': "quote",
+	'`':  "quasiquote",
+}
+
+// decodeDynamic reads the next S-expression without a static Go type
+// to guide it, for use inside quoted forms and dotted pairs where no
+// such type is known. Idents decode to strings (except "nil" and
+// "t"), and lists decode to []interface{}.
+func decodeDynamic(lex *lexer) (interface{}, error) {
+	switch lex.token {
+	case scanner.Ident:
+		switch lex.text() {
+		case "nil":
+			lex.next()
+			return nil, nil
+		case "t":
+			lex.next()
+			return true, nil
+		}
+		s := lex.text()
+		lex.next()
+		return s, nil
+
+	case scanner.String:
+		s, err := strconv.Unquote(lex.text())
+		if err != nil {
+			return nil, lex.syntaxError("invalid string literal %s: %v", lex.text(), err)
+		}
+		lex.next()
+		return s, nil
+
+	case scanner.Int:
+		n, err := strconv.ParseInt(lex.text(), 10, 64)
+		if err != nil {
+			return nil, lex.syntaxError("invalid integer literal %s: %v", lex.text(), err)
+		}
+		lex.next()
+		return n, nil
+
+	case scanner.Float:
+		f, err := strconv.ParseFloat(lex.text(), 64)
+		if err != nil {
+			return nil, lex.syntaxError("invalid float literal %s: %v", lex.text(), err)
+		}
+		lex.next()
+		return f, nil
+
+	case '#':
+		lex.next()
+		if lex.token == scanner.Ident {
+			switch lex.text() {
+			case "t":
+				lex.next()
+				return true, nil
+			case "f":
+				lex.next()
+				return false, nil
+			}
+		}
+		return nil, lex.syntaxError("unsupported # form")
+
+	case '-':
+		lex.next()
+		val, err := decodeDynamic(lex)
+		if err != nil {
+			return nil, err
+		}
+		switch n := val.(type) {
+		case int64:
+			return -n, nil
+		case float64:
+			return -n, nil
+		default:
+			return nil, lex.syntaxError("unary - not valid before %v", val)
+		}
+
+	case '(':
+		lex.next()
+		var items []interface{}
+		for {
+			end, err := endList(lex)
+			if err != nil {
+				return nil, err
+			}
+			if end {
+				break
+			}
+			item, err := decodeDynamic(lex)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		if err := lex.consume(')'); err != nil {
+			return nil, err
+		}
+		return items, nil
+
+	case '\'', '`':
+		sym := quoteSymbols[lex.token]
+		lex.next()
+		val, err := decodeDynamic(lex)
+		if err != nil {
+			return nil, err
+		}
+		return Quote{Symbol: sym, Value: val}, nil
+
+	case ',':
+		lex.next()
+		sym := "unquote"
+		if lex.token == '@' {
+			sym = "unquote-splicing"
+			lex.next()
+		}
+		val, err := decodeDynamic(lex)
+		if err != nil {
+			return nil, err
+		}
+		return Quote{Symbol: sym, Value: val}, nil
+	}
+	return nil, lex.syntaxError("unexpected token %d %q", lex.token, lex.text())
+}
+
+// readPair decodes the elements of a list already positioned just
+// after its opening '(' into a chain of Pairs, stopping at (but not
+// consuming) the closing ')'. A dotted tail ". x" terminates the
+// chain with Cdr set to x instead of to another Pair.
+func readPair(lex *lexer) (interface{}, error) {
+	end, err := endList(lex)
+	if err != nil {
+		return nil, err
+	}
+	if end {
+		return nil, nil // the empty list is Lisp nil
+	}
+
+	car, err := decodeDynamic(lex)
+	if err != nil {
+		return nil, err
+	}
+
+	if lex.token == '.' {
+		lex.next()
+		cdr, err := decodeDynamic(lex)
+		if err != nil {
+			return nil, err
+		}
+		return Pair{Car: car, Cdr: cdr}, nil
+	}
+
+	cdr, err := readPair(lex)
+	if err != nil {
+		return nil, err
+	}
+	return Pair{Car: car, Cdr: cdr}, nil
+}
@@ -0,0 +1,226 @@
+// Copyright © 2016 Alan A. A. Donovan & Brian W. Kernighan.
+// License: https://creativecommons.org/licenses/by-nc-sa/4.0/
+
+package sexpr
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type innerT struct {
+	A int
+	B int
+}
+
+type outerT struct {
+	Inner innerT `sexpr:",inline"`
+	Name  string
+	Zip   string `sexpr:",omitempty"`
+}
+
+func TestMarshalUnmarshalRoundTrip(t *testing.T) {
+	in := outerT{Inner: innerT{A: 1, B: 2}, Name: "gopher"}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if strings.Contains(string(data), "Zip") {
+		t.Errorf("Marshal(%+v) = %s, want Zip omitted", in, data)
+	}
+
+	var out outerT
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", data, err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round-trip mismatch: got %+v, want %+v", out, in)
+	}
+}
+
+func TestCanonicalRoundTrip(t *testing.T) {
+	type point struct {
+		X, Y float64
+	}
+	in := outerT{Inner: innerT{A: 3, B: 4}, Name: "canonical", Zip: "94110"}
+	data, err := MarshalCanonical(in)
+	if err != nil {
+		t.Fatalf("MarshalCanonical: %v", err)
+	}
+	var out outerT
+	if err := UnmarshalCanonical(data, &out); err != nil {
+		t.Fatalf("UnmarshalCanonical(%s): %v", data, err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("canonical round-trip mismatch: got %+v, want %+v", out, in)
+	}
+
+	p := point{X: 1.5, Y: -2.25}
+	pdata, err := MarshalCanonical(p)
+	if err != nil {
+		t.Fatalf("MarshalCanonical(%+v): %v", p, err)
+	}
+	var p2 point
+	if err := UnmarshalCanonical(pdata, &p2); err != nil {
+		t.Fatalf("UnmarshalCanonical(%s): %v", pdata, err)
+	}
+	if p != p2 {
+		t.Errorf("canonical float round-trip: got %+v, want %+v", p2, p)
+	}
+}
+
+func TestNegativeNumbers(t *testing.T) {
+	tests := []struct {
+		data string
+		want int
+	}{
+		{"-5", -5},
+		{"5", 5},
+	}
+	for _, tt := range tests {
+		var n int
+		if err := Unmarshal([]byte(tt.data), &n); err != nil {
+			t.Errorf("Unmarshal(%q): %v", tt.data, err)
+			continue
+		}
+		if n != tt.want {
+			t.Errorf("Unmarshal(%q) = %d, want %d", tt.data, n, tt.want)
+		}
+	}
+
+	var f float64
+	if err := Unmarshal([]byte("-1.5"), &f); err != nil {
+		t.Errorf("Unmarshal(-1.5): %v", err)
+	} else if f != -1.5 {
+		t.Errorf("Unmarshal(-1.5) = %v, want -1.5", f)
+	}
+}
+
+func TestQuoteAndDottedForms(t *testing.T) {
+	var q interface{}
+	if err := Unmarshal([]byte("'foo"), &q); err != nil {
+		t.Fatalf("Unmarshal('foo): %v", err)
+	}
+	quote, ok := q.(Quote)
+	if !ok || quote.Symbol != "quote" || quote.Value != "foo" {
+		t.Errorf("Unmarshal('foo) = %#v, want Quote{quote, foo}", q)
+	}
+
+	var pair Pair
+	if err := Unmarshal([]byte("(1 2 . 3)"), &pair); err != nil {
+		t.Fatalf("Unmarshal((1 2 . 3)): %v", err)
+	}
+	want := Pair{Car: int64(1), Cdr: Pair{Car: int64(2), Cdr: int64(3)}}
+	if !reflect.DeepEqual(pair, want) {
+		t.Errorf("Unmarshal((1 2 . 3)) = %#v, want %#v", pair, want)
+	}
+}
+
+func TestTokenAndSkip(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("(1 2 3) 4"))
+
+	tok, err := dec.Token()
+	if err != nil || tok != (StartList{}) {
+		t.Fatalf("first token = %#v, %v; want StartList{}", tok, err)
+	}
+	first, err := dec.Token()
+	if err != nil || first != (Atom{Kind: IntAtom, Value: int64(1)}) {
+		t.Fatalf("second token = %#v, %v; want Atom(1)", first, err)
+	}
+	// Skip discards the next atom (the 2) without surfacing it as a token.
+	if err := dec.Skip(); err != nil {
+		t.Fatalf("Skip: %v", err)
+	}
+	third, err := dec.Token()
+	if err != nil || third != (Atom{Kind: IntAtom, Value: int64(3)}) {
+		t.Fatalf("token after Skip = %#v, %v; want Atom(3)", third, err)
+	}
+	if tok, err := dec.Token(); err != nil || tok != (EndList{}) {
+		t.Fatalf("closing token = %#v, %v; want EndList{}", tok, err)
+	}
+
+	var n int
+	if err := dec.Decode(&n); err != nil || n != 4 {
+		t.Fatalf("Decode after Token stream = %d, %v; want 4, nil", n, err)
+	}
+}
+
+func TestSkipThenDecode(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("1 2 3"))
+	var a int
+	if err := dec.Decode(&a); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if err := dec.Skip(); err != nil {
+		t.Fatalf("Skip: %v", err)
+	}
+	var c int
+	if err := dec.Decode(&c); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if a != 1 || c != 3 {
+		t.Errorf("got a=%d c=%d, want a=1 c=3 (Skip should have consumed the 2)", a, c)
+	}
+}
+
+type rawHolder struct {
+	A int
+	R RawMessage
+}
+
+func TestRawMessageOverAtomKinds(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`((A 1) (R 42))`, "42"},
+		{`((A 1) (R -5))`, "-5"},
+		{`((A 1) (R 1.5))`, "1.5"},
+		{`((A 1) (R "hi"))`, `"hi"`},
+		{`((A 1) (R #t))`, "#t"},
+		{`((A 1) (R #f))`, "#f"},
+		{`((A 1) (R (1 2)))`, "(1 2)"},
+	}
+	for _, tt := range tests {
+		var h rawHolder
+		if err := Unmarshal([]byte(tt.data), &h); err != nil {
+			t.Errorf("Unmarshal(%q): %v", tt.data, err)
+			continue
+		}
+		if string(h.R) != tt.want {
+			t.Errorf("Unmarshal(%q).R = %q, want %q", tt.data, h.R, tt.want)
+		}
+	}
+}
+
+type boolUnmarshaler struct{ v bool }
+
+func (b *boolUnmarshaler) UnmarshalSExpr(data []byte) error {
+	return Unmarshal(data, &b.v)
+}
+
+func TestUnmarshalerOverHashForm(t *testing.T) {
+	type holder struct{ M boolUnmarshaler }
+	var h holder
+	if err := Unmarshal([]byte(`((M #f))`), &h); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if h.M.v {
+		t.Errorf("got M.v = true, want false")
+	}
+}
+
+func TestBufferedTextMode(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader([]byte("42 trailing")))
+	var n int
+	if err := dec.Decode(&n); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	var rest bytes.Buffer
+	rest.ReadFrom(dec.Buffered())
+	if got := strings.TrimSpace(rest.String()); got != "trailing" {
+		t.Errorf("Buffered() = %q, want %q", got, "trailing")
+	}
+}
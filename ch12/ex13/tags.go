@@ -0,0 +1,62 @@
+// Copyright © 2016 Alan A. A. Donovan & Brian W. Kernighan.
+// License: https://creativecommons.org/licenses/by-nc-sa/4.0/
+
+package sexpr
+
+import (
+	"reflect"
+	"strings"
+)
+
+// parseTag splits a struct tag of the form "name,opt1,opt2" into its
+// name and option parts, mirroring the convention used by
+// encoding/json and encoding/xml.
+func parseTag(tag string) (name string, opts []string) {
+	parts := strings.Split(tag, ",")
+	return parts[0], parts[1:]
+}
+
+// hasOption reports whether opts contains want.
+func hasOption(opts []string, want string) bool {
+	for _, opt := range opts {
+		if opt == want {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldTags builds the map from S-expression field name to the index
+// path of the corresponding Go struct field, used by readList and
+// readCanonicalList when they decode a struct from ((name value) ...).
+// The path is suitable for reflect.Value.FieldByIndex; a lookup by
+// field name would only reach fields promoted through anonymous
+// embedding, not a non-anonymous field merged in via ",inline".
+//
+// A field tagged ",inline" (or whose type is an anonymous/embedded
+// struct) has its own fields merged directly into the result, so that
+// its keys appear alongside its parent's rather than nested inside
+// their own sub-list.
+func fieldTags(t reflect.Type) map[string][]int {
+	tags := make(map[string][]int)
+	addFieldTags(t, nil, tags)
+	return tags
+}
+
+func addFieldTags(t reflect.Type, prefix []int, tags map[string][]int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts := parseTag(f.Tag.Get("sexpr"))
+		index := append(append([]int{}, prefix...), i)
+
+		if f.Type.Kind() == reflect.Struct && (f.Anonymous || hasOption(opts, "inline")) {
+			addFieldTags(f.Type, index, tags)
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		tags[name] = index
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright © 2016 Alan A. A. Donovan & Brian W. Kernighan.
+// License: https://creativecommons.org/licenses/by-nc-sa/4.0/
+
+package sexpr
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"text/scanner"
+)
+
+// Token is implemented by each event kind produced by Decoder.Token:
+// StartList, EndList, Atom, Dotted, and QuoteToken. It lets a caller
+// walk a very large S-expression document one piece at a time instead
+// of materializing it into a Go value through reflect, the way
+// xml.Decoder.Token works for XML.
+//
+// The token-stream quote event is named QuoteToken rather than Quote
+// to avoid colliding with the Quote value type (see lisp.go) used
+// when a reader macro is decoded into an interface{} field.
+type Token interface {
+	sexprToken()
+}
+
+// StartList marks the beginning of a list; a matching EndList always
+// follows once its elements have been read.
+type StartList struct{}
+
+func (StartList) sexprToken() {}
+
+// EndList marks the end of the innermost open list.
+type EndList struct{}
+
+func (EndList) sexprToken() {}
+
+// Dotted marks the '.' separating the head of a dotted pair from its
+// tail, e.g. the token stream for (1 . 2) is
+// StartList, Atom{IntAtom, int64(1)}, Dotted, Atom{IntAtom, int64(2)}, EndList.
+type Dotted struct{}
+
+func (Dotted) sexprToken() {}
+
+// QuoteToken reports a reader-macro prefix; the value it quotes
+// follows as the next token(s) in the stream.
+type QuoteToken struct {
+	Symbol string // "quote", "quasiquote", "unquote", or "unquote-splicing"
+}
+
+func (QuoteToken) sexprToken() {}
+
+// AtomKind identifies the lexical kind of an Atom token.
+type AtomKind int
+
+const (
+	IdentAtom AtomKind = iota
+	StringAtom
+	IntAtom
+	FloatAtom
+	BoolAtom
+)
+
+// Atom is a scalar value: an identifier, string, integer, float, or
+// #t/#f boolean. Value holds a string, int64, float64, bool, or nil
+// (for the identifier "nil").
+type Atom struct {
+	Kind  AtomKind
+	Value interface{}
+}
+
+func (Atom) sexprToken() {}
+
+// Token returns the next token in the input as a Token event, without
+// decoding it into a Go value via reflect. It does not support the
+// #C(re im) complex-number form; use Decode for values that need it.
+// Token is not supported in canonical mode (see SetCanonical), since
+// csexp has no token-level grammar analogous to the text form's.
+func (d *Decoder) Token() (Token, error) {
+	if d.canonical {
+		return nil, fmt.Errorf("sexpr: Token is not supported in canonical mode")
+	}
+	d.ensureStarted()
+	return nextToken(d.lex)
+}
+
+// Skip discards the next whole S-expression from the input, cheaply
+// enough to bypass a large subtree the caller isn't interested in.
+// Skip is not supported in canonical mode (see SetCanonical).
+func (d *Decoder) Skip() error {
+	if d.canonical {
+		return fmt.Errorf("sexpr: Skip is not supported in canonical mode")
+	}
+	d.ensureStarted()
+	return skipValue(d.lex)
+}
+
+func nextToken(lex *lexer) (Token, error) {
+	switch lex.token {
+	case scanner.EOF:
+		return nil, io.EOF
+
+	case '(':
+		lex.next()
+		return StartList{}, nil
+
+	case ')':
+		lex.next()
+		return EndList{}, nil
+
+	case '.':
+		lex.next()
+		return Dotted{}, nil
+
+	case '\'', '`':
+		sym := quoteSymbols[lex.token]
+		lex.next()
+		return QuoteToken{Symbol: sym}, nil
+
+	case ',':
+		lex.next()
+		sym := "unquote"
+		if lex.token == '@' {
+			sym = "unquote-splicing"
+			lex.next()
+		}
+		return QuoteToken{Symbol: sym}, nil
+
+	case scanner.Ident:
+		switch lex.text() {
+		case "nil":
+			lex.next()
+			return Atom{Kind: IdentAtom, Value: nil}, nil
+		case "t":
+			lex.next()
+			return Atom{Kind: BoolAtom, Value: true}, nil
+		}
+		s := lex.text()
+		lex.next()
+		return Atom{Kind: IdentAtom, Value: s}, nil
+
+	case scanner.String:
+		s, err := strconv.Unquote(lex.text())
+		if err != nil {
+			return nil, lex.syntaxError("invalid string literal %s: %v", lex.text(), err)
+		}
+		lex.next()
+		return Atom{Kind: StringAtom, Value: s}, nil
+
+	case scanner.Int:
+		n, err := strconv.ParseInt(lex.text(), 10, 64)
+		if err != nil {
+			return nil, lex.syntaxError("invalid integer literal %s: %v", lex.text(), err)
+		}
+		lex.next()
+		return Atom{Kind: IntAtom, Value: n}, nil
+
+	case scanner.Float:
+		f, err := strconv.ParseFloat(lex.text(), 64)
+		if err != nil {
+			return nil, lex.syntaxError("invalid float literal %s: %v", lex.text(), err)
+		}
+		lex.next()
+		return Atom{Kind: FloatAtom, Value: f}, nil
+
+	case '-':
+		lex.next()
+		tok, err := nextToken(lex)
+		if err != nil {
+			return nil, err
+		}
+		atom, ok := tok.(Atom)
+		if !ok {
+			return nil, lex.syntaxError("unexpected token after '-'")
+		}
+		switch n := atom.Value.(type) {
+		case int64:
+			atom.Value = -n
+		case float64:
+			atom.Value = -n
+		default:
+			return nil, lex.syntaxError("unary - not valid before %v", atom.Value)
+		}
+		return atom, nil
+
+	case '#':
+		lex.next()
+		if lex.token == scanner.Ident {
+			switch lex.text() {
+			case "t":
+				lex.next()
+				return Atom{Kind: BoolAtom, Value: true}, nil
+			case "f":
+				lex.next()
+				return Atom{Kind: BoolAtom, Value: false}, nil
+			}
+		}
+		return nil, lex.syntaxError("unsupported # form")
+	}
+	return nil, lex.syntaxError("unexpected token %d %q", lex.token, lex.text())
+}
+
+// skipValue discards one whole value: an atom, a quote prefix plus
+// the value it quotes, or a list down to its matching EndList.
+func skipValue(lex *lexer) error {
+	tok, err := nextToken(lex)
+	if err != nil {
+		return err
+	}
+	switch tok.(type) {
+	case StartList:
+		depth := 1
+		for depth > 0 {
+			tok, err := nextToken(lex)
+			if err != nil {
+				return err
+			}
+			switch tok.(type) {
+			case StartList:
+				depth++
+			case EndList:
+				depth--
+			}
+		}
+		return nil
+
+	case QuoteToken:
+		return skipValue(lex)
+
+	default:
+		return nil
+	}
+}